@@ -0,0 +1,329 @@
+// Package socks5 implements the server side of a SOCKS5 handshake per
+// RFC 1928, plus the username/password sub-negotiation from RFC 1929.
+//
+// It only implements what Snowflake's local proxy needs: CONNECT and UDP
+// ASSOCIATE commands, and username/password credentials that callers may
+// repurpose to carry per-connection bridge selection (mirroring how Tor's
+// obfs4proxy accepts bridge args through the same fields).
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Protocol constants from RFC 1928 / RFC 1929.
+const (
+	Version = 0x05
+
+	MethodNoAuth       = 0x00
+	MethodUserPass     = 0x02
+	MethodNoAcceptable = 0xFF
+
+	userPassVersion = 0x01
+
+	CmdConnect      = 0x01
+	CmdBind         = 0x02
+	CmdUDPAssociate = 0x03
+
+	ATYPIPv4   = 0x01
+	ATYPDomain = 0x03
+	ATYPIPv6   = 0x04
+
+	ReplySucceeded           = 0x00
+	ReplyGeneralFailure      = 0x01
+	ReplyCommandNotSupported = 0x07
+	ReplyAddrNotSupported    = 0x08
+)
+
+// Request is a parsed SOCKS5 CONNECT/UDP ASSOCIATE request.
+type Request struct {
+	Cmd     byte
+	DstAddr string
+	DstPort uint16
+
+	// Username and Password are populated only if the client authenticated
+	// with method 0x02. Snowflake does not verify them against a real
+	// credential store — callers may use them to key per-app isolation or
+	// to carry a caller-chosen bridge line.
+	Username string
+	Password string
+}
+
+// Handshake performs the SOCKS5 method negotiation, optional RFC 1929
+// username/password sub-negotiation, and reads the request header. It does
+// not write the final reply — callers do that with WriteReply once they
+// know whether the request can be satisfied.
+func Handshake(conn net.Conn) (*Request, error) {
+	methods, err := readMethods(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	method := byte(MethodNoAcceptable)
+	for _, m := range methods {
+		if m == MethodUserPass {
+			method = MethodUserPass
+			break
+		}
+		if m == MethodNoAuth && method != MethodUserPass {
+			method = MethodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{Version, method}); err != nil {
+		return nil, fmt.Errorf("socks5: writing method reply: %v", err)
+	}
+	if method == MethodNoAcceptable {
+		return nil, fmt.Errorf("socks5: no acceptable auth method offered")
+	}
+
+	req := &Request{}
+	if method == MethodUserPass {
+		user, pass, err := readUserPass(conn)
+		if err != nil {
+			return nil, err
+		}
+		req.Username, req.Password = user, pass
+	}
+
+	if err := readRequestHeader(conn, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func readMethods(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("socks5: reading greeting: %v", err)
+	}
+	if hdr[0] != Version {
+		return nil, fmt.Errorf("socks5: unsupported version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, fmt.Errorf("socks5: reading methods: %v", err)
+	}
+	return methods, nil
+}
+
+func readUserPass(conn net.Conn) (user, pass string, err error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr[:2]); err != nil {
+		return "", "", fmt.Errorf("socks5: reading userpass version/ulen: %v", err)
+	}
+	if hdr[0] != userPassVersion {
+		return "", "", fmt.Errorf("socks5: unsupported userpass version %d", hdr[0])
+	}
+	uname := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, uname); err != nil {
+		return "", "", fmt.Errorf("socks5: reading username: %v", err)
+	}
+	plenBuf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, plenBuf); err != nil {
+		return "", "", fmt.Errorf("socks5: reading plen: %v", err)
+	}
+	passwd := make([]byte, plenBuf[0])
+	if _, err := io.ReadFull(conn, passwd); err != nil {
+		return "", "", fmt.Errorf("socks5: reading password: %v", err)
+	}
+	// Always accept: Snowflake repurposes these fields rather than
+	// authenticating against a real credential store.
+	if _, err := conn.Write([]byte{userPassVersion, ReplySucceeded}); err != nil {
+		return "", "", fmt.Errorf("socks5: writing userpass reply: %v", err)
+	}
+	return string(uname), string(passwd), nil
+}
+
+func readRequestHeader(conn net.Conn, req *Request) error {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return fmt.Errorf("socks5: reading request header: %v", err)
+	}
+	req.Cmd = hdr[1]
+
+	addr, err := readAddr(conn, hdr[3])
+	if err != nil {
+		return err
+	}
+	req.DstAddr = addr
+
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBuf); err != nil {
+		return fmt.Errorf("socks5: reading dst port: %v", err)
+	}
+	req.DstPort = binary.BigEndian.Uint16(portBuf)
+	return nil
+}
+
+func readAddr(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case ATYPIPv4:
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", fmt.Errorf("socks5: reading ipv4 addr: %v", err)
+		}
+		return net.IP(b).String(), nil
+	case ATYPIPv6:
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", fmt.Errorf("socks5: reading ipv6 addr: %v", err)
+		}
+		return net.IP(b).String(), nil
+	case ATYPDomain:
+		lenBuf := make([]byte, 1)
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			return "", fmt.Errorf("socks5: reading domain len: %v", err)
+		}
+		b := make([]byte, lenBuf[0])
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", fmt.Errorf("socks5: reading domain: %v", err)
+		}
+		return string(b), nil
+	default:
+		return "", fmt.Errorf("socks5: unsupported address type %d", atyp)
+	}
+}
+
+// WriteReply writes a SOCKS5 reply with the given status and bound
+// address. bindAddr may be empty (encoded as 0.0.0.0:0), which is all
+// Snowflake's CONNECT path needs since it doesn't expose a real bind
+// address.
+func WriteReply(conn net.Conn, reply byte, bindAddr string, bindPort uint16) error {
+	ip := net.IPv4zero
+	if bindAddr != "" {
+		if parsed := net.ParseIP(bindAddr); parsed != nil {
+			ip = parsed
+		}
+	}
+	atyp := byte(ATYPIPv4)
+	ip4 := ip.To4()
+	if ip4 == nil {
+		atyp = ATYPIPv6
+		ip4 = ip.To16()
+	}
+
+	out := make([]byte, 0, 6+len(ip4))
+	out = append(out, Version, reply, 0x00, atyp)
+	out = append(out, ip4...)
+	out = append(out, byte(bindPort>>8), byte(bindPort))
+	_, err := conn.Write(out)
+	return err
+}
+
+// UDPDatagram is a parsed RFC 1928 §7 UDP request/reply header plus
+// payload, as exchanged between a SOCKS5 client and the UDP relay socket
+// opened for a UDP ASSOCIATE session.
+type UDPDatagram struct {
+	DstAddr string
+	DstPort uint16
+	Data    []byte
+}
+
+// DecodeUDPDatagram parses a UDP ASSOCIATE datagram. Fragmentation (FRAG
+// != 0) is not supported, matching Tor's own SOCKS5 UDP usage.
+func DecodeUDPDatagram(b []byte) (*UDPDatagram, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("socks5: udp datagram too short")
+	}
+	if b[2] != 0x00 {
+		return nil, fmt.Errorf("socks5: fragmented udp datagrams not supported")
+	}
+	atyp := b[3]
+	rest := b[4:]
+
+	var addr string
+	var portOffset int
+	switch atyp {
+	case ATYPIPv4:
+		if len(rest) < 4+2 {
+			return nil, fmt.Errorf("socks5: udp ipv4 datagram too short")
+		}
+		addr = net.IP(rest[:4]).String()
+		portOffset = 4
+	case ATYPIPv6:
+		if len(rest) < 16+2 {
+			return nil, fmt.Errorf("socks5: udp ipv6 datagram too short")
+		}
+		addr = net.IP(rest[:16]).String()
+		portOffset = 16
+	case ATYPDomain:
+		if len(rest) < 1 {
+			return nil, fmt.Errorf("socks5: udp domain datagram too short")
+		}
+		domLen := int(rest[0])
+		if len(rest) < 1+domLen+2 {
+			return nil, fmt.Errorf("socks5: udp domain datagram too short")
+		}
+		addr = string(rest[1 : 1+domLen])
+		portOffset = 1 + domLen
+	default:
+		return nil, fmt.Errorf("socks5: unsupported udp address type %d", atyp)
+	}
+
+	port := binary.BigEndian.Uint16(rest[portOffset : portOffset+2])
+	return &UDPDatagram{
+		DstAddr: addr,
+		DstPort: port,
+		Data:    rest[portOffset+2:],
+	}, nil
+}
+
+// EncodeUDPDatagram serializes d into the RFC 1928 §7 wire format.
+func EncodeUDPDatagram(d *UDPDatagram) ([]byte, error) {
+	ip := net.ParseIP(d.DstAddr)
+	var atyp byte
+	var addrBytes []byte
+	switch {
+	case ip == nil:
+		if len(d.DstAddr) > 255 {
+			return nil, fmt.Errorf("socks5: domain name too long")
+		}
+		atyp = ATYPDomain
+		addrBytes = append([]byte{byte(len(d.DstAddr))}, []byte(d.DstAddr)...)
+	case ip.To4() != nil:
+		atyp = ATYPIPv4
+		addrBytes = ip.To4()
+	default:
+		atyp = ATYPIPv6
+		addrBytes = ip.To16()
+	}
+
+	out := make([]byte, 0, 4+len(addrBytes)+2+len(d.Data))
+	out = append(out, 0x00, 0x00, 0x00, atyp)
+	out = append(out, addrBytes...)
+	out = append(out, byte(d.DstPort>>8), byte(d.DstPort))
+	out = append(out, d.Data...)
+	return out, nil
+}
+
+// WriteFramed writes payload to w prefixed with its big-endian uint16
+// length, the framing used to multiplex UDP datagrams over a single
+// Snowflake DataChannel stream.
+func WriteFramed(w io.Writer, payload []byte) error {
+	if len(payload) > 0xFFFF {
+		return fmt.Errorf("socks5: frame too large (%d bytes)", len(payload))
+	}
+	hdr := []byte{byte(len(payload) >> 8), byte(len(payload))}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// ReadFramed reads one length-prefixed frame written by WriteFramed.
+func ReadFramed(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint16(hdr)
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
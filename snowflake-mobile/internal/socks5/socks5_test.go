@@ -0,0 +1,94 @@
+package socks5
+
+import "testing"
+
+func TestEncodeDecodeUDPDatagram(t *testing.T) {
+	tests := []struct {
+		name string
+		in   *UDPDatagram
+	}{
+		{"ipv4", &UDPDatagram{DstAddr: "192.0.2.1", DstPort: 53, Data: []byte("hello")}},
+		{"ipv6", &UDPDatagram{DstAddr: "2001:db8::1", DstPort: 443, Data: []byte{1, 2, 3}}},
+		{"domain", &UDPDatagram{DstAddr: "example.org", DstPort: 80, Data: []byte("payload")}},
+		{"empty payload", &UDPDatagram{DstAddr: "198.51.100.2", DstPort: 1, Data: nil}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := EncodeUDPDatagram(tt.in)
+			if err != nil {
+				t.Fatalf("EncodeUDPDatagram: %v", err)
+			}
+			got, err := DecodeUDPDatagram(encoded)
+			if err != nil {
+				t.Fatalf("DecodeUDPDatagram: %v", err)
+			}
+			if got.DstAddr != tt.in.DstAddr {
+				t.Errorf("DstAddr = %q, want %q", got.DstAddr, tt.in.DstAddr)
+			}
+			if got.DstPort != tt.in.DstPort {
+				t.Errorf("DstPort = %d, want %d", got.DstPort, tt.in.DstPort)
+			}
+			if string(got.Data) != string(tt.in.Data) {
+				t.Errorf("Data = %v, want %v", got.Data, tt.in.Data)
+			}
+		})
+	}
+}
+
+func TestDecodeUDPDatagramRejectsFragments(t *testing.T) {
+	encoded, err := EncodeUDPDatagram(&UDPDatagram{DstAddr: "192.0.2.1", DstPort: 1, Data: []byte("x")})
+	if err != nil {
+		t.Fatalf("EncodeUDPDatagram: %v", err)
+	}
+	encoded[2] = 1 // set FRAG != 0
+	if _, err := DecodeUDPDatagram(encoded); err == nil {
+		t.Fatal("expected error decoding a fragmented datagram, got nil")
+	}
+}
+
+func TestWriteReadFramed(t *testing.T) {
+	tests := [][]byte{
+		[]byte("hello"),
+		{},
+		make([]byte, 0xFFFF),
+	}
+
+	for _, payload := range tests {
+		var buf bufCloser
+		if err := WriteFramed(&buf, payload); err != nil {
+			t.Fatalf("WriteFramed: %v", err)
+		}
+		got, err := ReadFramed(&buf)
+		if err != nil {
+			t.Fatalf("ReadFramed: %v", err)
+		}
+		if len(got) != len(payload) {
+			t.Fatalf("ReadFramed returned %d bytes, want %d", len(got), len(payload))
+		}
+	}
+}
+
+func TestWriteFramedRejectsOversizePayload(t *testing.T) {
+	var buf bufCloser
+	if err := WriteFramed(&buf, make([]byte, 0x10000)); err == nil {
+		t.Fatal("expected error writing an oversize frame, got nil")
+	}
+}
+
+// bufCloser is a minimal in-memory io.ReadWriter for WriteFramed/ReadFramed
+// round-trip tests.
+type bufCloser struct {
+	data []byte
+}
+
+func (b *bufCloser) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
+
+func (b *bufCloser) Read(p []byte) (int, error) {
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
@@ -0,0 +1,31 @@
+package snowflake
+
+import "net/url"
+
+// parseBridgeLine decodes a per-connection bridge override carried in a
+// SOCKS5 password field, mirroring how Tor's obfs4proxy accepts bridge
+// args through the same fields. This lets the mobile app pick a bridge
+// per SOCKS5 connection instead of only at NewClient time.
+//
+// Format is a URL query string, e.g.
+// "broker=https://example.org/&front=a.cdn.com,b.cdn.com&amp=https://cdn.ampproject.org/".
+// An empty password means "use the pooled, auto-rotating CDN list", so ok
+// is false.
+func parseBridgeLine(password string) (cdn cdnConfig, ok bool) {
+	if password == "" {
+		return cdnConfig{}, false
+	}
+	values, err := url.ParseQuery(password)
+	if err != nil {
+		return cdnConfig{}, false
+	}
+	broker := values.Get("broker")
+	if broker == "" {
+		return cdnConfig{}, false
+	}
+	return cdnConfig{
+		brokerURL:    broker,
+		frontDomains: splitTrimmed(values.Get("front")),
+		ampCacheURL:  values.Get("amp"),
+	}, true
+}
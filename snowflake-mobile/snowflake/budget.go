@@ -0,0 +1,95 @@
+package snowflake
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrThrottled is returned by handle() when a new connection is rejected
+// because the configured Budget has been exceeded for the current window.
+var ErrThrottled = errors.New("snowflake: data budget exceeded")
+
+// Budget caps how much traffic the client will relay in each fixed
+// TimeWindow, for users on metered mobile plans. Once BytesLimit is
+// reached, new SOCKS5 connections fail fast with ErrThrottled until the
+// window rolls over and the counters reset.
+type Budget struct {
+	BytesLimit int64
+	TimeWindow time.Duration
+	// OnExceeded, if set, is called once when the budget is first exceeded
+	// in a window (not on every subsequent connection attempt).
+	OnExceeded func()
+}
+
+// countingConn wraps a net.Conn, atomically adding every byte read to
+// counter. Writes pass through unmodified — handle() wraps whichever side
+// of the pipe is the actual source for each copy direction, so each byte
+// is counted exactly once.
+type countingConn struct {
+	net.Conn
+	counter *int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.AddInt64(c.counter, int64(n))
+	}
+	return n, err
+}
+
+// SetBudget installs (or clears, with nil) a data budget. Safe to call
+// before or while the client is running.
+func (c *SnowflakeClient) SetBudget(b *Budget) {
+	c.budgetMu.Lock()
+	defer c.budgetMu.Unlock()
+	c.budget = b
+	c.windowStart = time.Now()
+	atomic.StoreInt64(&c.bytesIn, 0)
+	atomic.StoreInt64(&c.bytesOut, 0)
+	atomic.StoreInt32(&c.throttled, 0)
+}
+
+// checkBudget rolls the accounting window over if it has elapsed, and
+// reports whether the budget (if any) is currently exceeded. It fires
+// Budget.OnExceeded exactly once per window on the transition into the
+// throttled state.
+func (c *SnowflakeClient) checkBudget() bool {
+	c.budgetMu.Lock()
+	budget := c.budget
+	if budget == nil {
+		c.budgetMu.Unlock()
+		return false
+	}
+	if budget.TimeWindow > 0 && time.Since(c.windowStart) >= budget.TimeWindow {
+		c.windowStart = time.Now()
+		atomic.StoreInt64(&c.bytesIn, 0)
+		atomic.StoreInt64(&c.bytesOut, 0)
+		atomic.StoreInt32(&c.throttled, 0)
+	}
+	c.budgetMu.Unlock()
+
+	used := atomic.LoadInt64(&c.bytesIn) + atomic.LoadInt64(&c.bytesOut)
+	exceeded := budget.BytesLimit > 0 && used >= budget.BytesLimit
+	if exceeded && atomic.CompareAndSwapInt32(&c.throttled, 0, 1) && budget.OnExceeded != nil {
+		budget.OnExceeded()
+	}
+	return exceeded
+}
+
+// IsThrottled reports whether the current Budget (if any) is exceeded for
+// this accounting window. The client keeps running and IsRunning() still
+// reports true — only new connections are refused.
+func (c *SnowflakeClient) IsThrottled() bool {
+	return atomic.LoadInt32(&c.throttled) == 1
+}
+
+// Stats returns the byte counts relayed since the last SetBudget call or
+// budget window rollover (both reset them), and the number of connections
+// currently being relayed. Safe to poll frequently from the gomobile side;
+// all three values are plain atomic loads.
+func (c *SnowflakeClient) Stats() (bytesIn, bytesOut, activeConns int64) {
+	return atomic.LoadInt64(&c.bytesIn), atomic.LoadInt64(&c.bytesOut), atomic.LoadInt64(&c.activeConns)
+}
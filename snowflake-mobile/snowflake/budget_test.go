@@ -0,0 +1,57 @@
+package snowflake
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestClientForBudget() *SnowflakeClient {
+	return &SnowflakeClient{pinnedIdx: -1}
+}
+
+func TestCheckBudgetNoBudgetSet(t *testing.T) {
+	c := newTestClientForBudget()
+	if c.checkBudget() {
+		t.Error("checkBudget() with no budget set should never throttle")
+	}
+}
+
+func TestCheckBudgetExceeded(t *testing.T) {
+	c := newTestClientForBudget()
+	var exceededCalls int
+	c.SetBudget(&Budget{BytesLimit: 10, TimeWindow: time.Hour, OnExceeded: func() { exceededCalls++ }})
+
+	c.bytesOut = 5
+	if c.checkBudget() {
+		t.Error("checkBudget() under the limit should not throttle")
+	}
+
+	c.bytesOut = 11
+	if !c.checkBudget() {
+		t.Error("checkBudget() over the limit should throttle")
+	}
+	if !c.checkBudget() {
+		t.Error("checkBudget() should stay throttled on repeat calls within the window")
+	}
+	if exceededCalls != 1 {
+		t.Errorf("OnExceeded called %d times, want exactly 1", exceededCalls)
+	}
+}
+
+func TestCheckBudgetWindowRollover(t *testing.T) {
+	c := newTestClientForBudget()
+	c.SetBudget(&Budget{BytesLimit: 10, TimeWindow: time.Millisecond})
+
+	c.bytesOut = 20
+	if !c.checkBudget() {
+		t.Fatal("checkBudget() over the limit should throttle")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if c.checkBudget() {
+		t.Error("checkBudget() after the window rolls over should reset usage and stop throttling")
+	}
+	if c.IsThrottled() {
+		t.Error("IsThrottled() should be false after a window rollover clears the throttle")
+	}
+}
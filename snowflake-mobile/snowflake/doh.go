@@ -0,0 +1,234 @@
+package snowflake
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dohProxy is a loopback-only HTTP CONNECT proxy that resolves its target
+// host via DNS-over-HTTPS instead of the system resolver, then splices the
+// tunnel through to the DoH-resolved address. sflib.ClientConfig has no
+// hook for a custom http.RoundTripper or dialer, but it does accept a
+// CommunicationProxy URL for routing broker traffic through a local proxy
+// — dohProxy is that local proxy. The TLS SNI and Host header the broker
+// sees are untouched, so DoH only has to survive DNS-based blocking of the
+// broker hostname, not IP-based blocking.
+type dohProxy struct {
+	ln       net.Listener
+	resolver *dohResolver
+}
+
+// newDoHProxy starts a dohProxy listening on an ephemeral loopback port.
+// Callers should keep it running for as long as any transport configured
+// with its proxyURL() may still dial, and close() it afterwards.
+func newDoHProxy(dohServer string) (*dohProxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("doh proxy: listen: %v", err)
+	}
+	p := &dohProxy{
+		ln:       ln,
+		resolver: &dohResolver{server: dohServer, client: &http.Client{Timeout: 10 * time.Second}},
+	}
+	go p.serve()
+	return p, nil
+}
+
+// proxyURL returns the CommunicationProxy URL sflib should dial the broker
+// through.
+func (p *dohProxy) proxyURL() *url.URL {
+	return &url.URL{Scheme: "http", Host: p.ln.Addr().String()}
+}
+
+func (p *dohProxy) close() error {
+	return p.ln.Close()
+}
+
+func (p *dohProxy) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		go p.handleConnect(conn)
+	}
+}
+
+// handleConnect services one HTTP CONNECT request, resolving its target
+// via DoH before dialing and then splicing the two connections together.
+func (p *dohProxy) handleConnect(conn net.Conn) {
+	defer conn.Close()
+
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host, port = req.Host, "443"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ip, err := p.resolver.lookupA(ctx, host)
+	cancel()
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+
+	target, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), port), 10*time.Second)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer target.Close()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); io.Copy(target, conn) }()
+	go func() { defer wg.Done(); io.Copy(conn, target) }()
+	wg.Wait()
+}
+
+// dohResolver resolves A records over DNS-over-HTTPS (RFC 8484, the
+// "application/dns-message" wire format, which every major public
+// resolver supports regardless of whether it also offers a JSON API).
+type dohResolver struct {
+	server string
+	client *http.Client
+}
+
+func (d *dohResolver) lookupA(ctx context.Context, host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+
+	query, err := buildDNSQuery(host)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.server, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh server returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	return firstARecord(body)
+}
+
+// buildDNSQuery builds a minimal single-question A-record query in DNS
+// wire format (RFC 1035 §4.1).
+func buildDNSQuery(host string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	id := uint16(rand.Intn(1 << 16))
+	header := []uint16{id, 0x0100 /* RD=1 */, 1 /* QDCOUNT */, 0, 0, 0}
+	for _, v := range header {
+		binary.Write(&buf, binary.BigEndian, v)
+	}
+
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("doh: invalid dns label %q", label)
+		}
+		buf.WriteByte(byte(len(label)))
+		buf.WriteString(label)
+	}
+	buf.WriteByte(0) // root label
+
+	binary.Write(&buf, binary.BigEndian, uint16(1)) // QTYPE A
+	binary.Write(&buf, binary.BigEndian, uint16(1)) // QCLASS IN
+	return buf.Bytes(), nil
+}
+
+// firstARecord extracts the first A-record answer from a DNS wire-format
+// response. It does not follow CNAME chains — every builtin DoH CDN entry
+// points dohServer at a broker hostname with its own A record.
+func firstARecord(msg []byte) (net.IP, error) {
+	if len(msg) < 12 {
+		return nil, fmt.Errorf("doh: response too short")
+	}
+	qdcount := binary.BigEndian.Uint16(msg[4:6])
+	ancount := binary.BigEndian.Uint16(msg[6:8])
+
+	pos := 12
+	for i := uint16(0); i < qdcount; i++ {
+		n, err := skipDNSName(msg, pos)
+		if err != nil {
+			return nil, err
+		}
+		pos = n + 4 // QTYPE + QCLASS
+	}
+
+	for i := uint16(0); i < ancount; i++ {
+		n, err := skipDNSName(msg, pos)
+		if err != nil {
+			return nil, err
+		}
+		pos = n
+		if pos+10 > len(msg) {
+			return nil, fmt.Errorf("doh: truncated answer record")
+		}
+		rtype := binary.BigEndian.Uint16(msg[pos : pos+2])
+		rdlen := binary.BigEndian.Uint16(msg[pos+8 : pos+10])
+		pos += 10
+		if pos+int(rdlen) > len(msg) {
+			return nil, fmt.Errorf("doh: truncated rdata")
+		}
+		if rtype == 1 && rdlen == 4 { // A record
+			return net.IP(msg[pos : pos+4]), nil
+		}
+		pos += int(rdlen)
+	}
+	return nil, fmt.Errorf("doh: no A record in response")
+}
+
+// skipDNSName advances past a (possibly compressed) DNS name starting at
+// pos and returns the position immediately after it.
+func skipDNSName(msg []byte, pos int) (int, error) {
+	for pos < len(msg) {
+		length := int(msg[pos])
+		switch {
+		case length == 0:
+			return pos + 1, nil
+		case length&0xC0 == 0xC0: // compression pointer
+			if pos+2 > len(msg) {
+				return 0, fmt.Errorf("doh: truncated name pointer")
+			}
+			return pos + 2, nil
+		default:
+			pos += 1 + length
+		}
+	}
+	return 0, fmt.Errorf("doh: truncated name")
+}
@@ -14,47 +14,192 @@ import (
 	"io"
 	"log"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	sflib "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/client/lib"
+
+	"snowflake-mobile/internal/socks5"
 )
 
 // maxDialFailures is the number of consecutive Dial() failures before
 // rotating to the next CDN configuration.
 const maxDialFailures = 5
 
-// cdnConfig holds a broker URL and its matching front domains.
-// If ampCacheURL is set, AMP cache rendezvous is used instead of domain fronting.
+const (
+	// raceCandidates is how many of the top-scored CDNs are raced in
+	// parallel when (re-)selecting a transport.
+	raceCandidates = 2
+	// reEvalInterval is how often a running client re-scores CDNs and
+	// considers switching away from the current one.
+	reEvalInterval = 5 * time.Minute
+	// defaultCDNCooldown is how long a CDN is deprioritized after its most
+	// recent dial attempt failed, unless overridden with SetCDNCooldown.
+	defaultCDNCooldown = 10 * time.Minute
+)
+
+// rendezvousType selects how a cdnConfig reaches the broker. Domain
+// fronting (the default) is increasingly unreliable as CDNs disable it, so
+// AMP cache, DoH, and SQS are offered as fronting-free alternatives.
+type rendezvousType int
+
+const (
+	RendezvousDomain rendezvousType = iota // classic domain fronting via frontDomains
+	RendezvousAMP                          // AMP cache rendezvous via ampCacheURL
+	RendezvousDoH                          // resolve the broker host via DoH instead of fronting
+	RendezvousSQS                          // poll an AWS SQS queue instead of talking to brokerURL directly
+)
+
+// cdnConfig holds a broker URL and the rendezvous method used to reach it.
+// dohServer and sqsQueueURL/sqsCredsB64 apply only to their own rendezvous
+// type; frontDomains and ampCacheURL are passed to sflib whenever set.
 type cdnConfig struct {
+	rendezvous rendezvousType
+
 	brokerURL    string
-	frontDomains []string
-	ampCacheURL  string // optional; uses AMP cache rendezvous when non-empty
+	frontDomains []string // set by RendezvousDomain and RendezvousAMP entries
+
+	ampCacheURL string // set by RendezvousAMP entries
+
+	dohServer string // used when rendezvous == RendezvousDoH; e.g. "https://dns.google/dns-query"
+
+	sqsQueueURL string // used when rendezvous == RendezvousSQS
+	sqsCredsB64 string // base64-encoded AWS creds for sqsQueueURL
 }
 
 // builtinCDNs are the CDN configurations to try, ordered by preference.
-// These match the latest Tor Browser defaults.
+// These match the latest Tor Browser defaults, plus fronting-free DoH and
+// SQS fallbacks for when CDNs stop accepting fronted requests entirely.
 var builtinCDNs = []cdnConfig{
 	{
+		rendezvous:   RendezvousDomain,
 		brokerURL:    "https://1098762253.rsc.cdn77.org/",
 		frontDomains: []string{"www.cdn77.com"},
 	},
 	{
 		// AMP cache rendezvous: routes broker requests through Google's AMP CDN.
 		// Very hard to block without blocking all of Google — best fallback for Iran.
+		rendezvous:   RendezvousAMP,
 		brokerURL:    "https://snowflake-broker.torproject.net/",
 		ampCacheURL:  "https://cdn.ampproject.org/",
 		frontDomains: []string{"www.google.com"},
 	},
 	{
+		rendezvous:   RendezvousDomain,
 		brokerURL:    "https://snowflake-broker.torproject.net.global.prod.fastly.net/",
 		frontDomains: []string{"www.shazam.com", "www.cosmopolitan.com", "www.esquire.com"},
 	},
 	{
+		rendezvous:   RendezvousDomain,
 		brokerURL:    "https://snowflake-broker.azureedge.net/",
 		frontDomains: []string{"ajax.aspnetcdn.com"},
 	},
+	{
+		// DoH rendezvous: resolves the broker hostname over DNS-over-HTTPS
+		// instead of fronting through a CDN. No fronting means no front
+		// domain to block, but it only helps where DNS (not the broker's
+		// own IP) is the censor's chokepoint.
+		rendezvous: RendezvousDoH,
+		brokerURL:  "https://snowflake-broker.torproject.net/",
+		dohServer:  "https://dns.google/dns-query",
+	},
+	{
+		// SQS rendezvous: the client and broker both poll an AWS SQS queue
+		// instead of the client talking to brokerURL at all, so there's no
+		// broker domain or front to block. sqsCredsB64 ships empty here —
+		// populate it (and sqsQueueURL, if using a private queue) via
+		// whatever config mechanism wires up builtinCDNs for a given build,
+		// since the credentials are account-specific.
+		rendezvous:  RendezvousSQS,
+		sqsQueueURL: "https://sqs.us-east-1.amazonaws.com/893902434899/snowflake-broker",
+	},
+}
+
+// cdnHealth tracks rolling health stats for one cdnConfig, used to score
+// and rank CDNs for selection and racing.
+type cdnHealth struct {
+	mu           sync.Mutex
+	successes    int64
+	failures     int64
+	totalDialDur time.Duration
+	lastSuccess  time.Time
+	lastFailure  time.Time
+}
+
+// recordSuccess records a successful dial and its latency.
+func (h *cdnHealth) recordSuccess(dur time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.successes++
+	h.totalDialDur += dur
+	h.lastSuccess = time.Now()
+}
+
+// recordFailure records a failed dial.
+func (h *cdnHealth) recordFailure() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures++
+	h.lastFailure = time.Now()
+}
+
+// restore seeds health stats from a previous run's persisted state.
+func (h *cdnHealth) restore(successes, failures int64, totalDialDur time.Duration, lastSuccess, lastFailure time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.successes = successes
+	h.failures = failures
+	h.totalDialDur = totalDialDur
+	h.lastSuccess = lastSuccess
+	h.lastFailure = lastFailure
+}
+
+// inCooldown reports whether this CDN's most recent event was a failure
+// within the last cooldown window, meaning it should be skipped for now.
+func (h *cdnHealth) inCooldown(cooldown time.Duration) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lastFailure.IsZero() || h.lastSuccess.After(h.lastFailure) {
+		return false
+	}
+	return time.Since(h.lastFailure) < cooldown
+}
+
+// score returns a higher-is-better health score combining success rate,
+// mean dial latency, and time since last success. CDNs with no history
+// score neutrally so they still get a chance to prove themselves.
+func (h *cdnHealth) score() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	total := h.successes + h.failures
+	if total == 0 {
+		return 0.5
+	}
+	successRate := float64(h.successes) / float64(total)
+
+	var meanLatency time.Duration
+	if h.successes > 0 {
+		meanLatency = h.totalDialDur / time.Duration(h.successes)
+	}
+	latencyPenalty := meanLatency.Seconds() * 0.05
+
+	var stalePenalty float64
+	if !h.lastSuccess.IsZero() {
+		stalePenalty = time.Since(h.lastSuccess).Minutes() * 0.001
+	}
+
+	return successRate - latencyPenalty - stalePenalty
+}
+
+// snapshot returns a read-only copy of the current stats.
+func (h *cdnHealth) snapshot() (successes, failures int64, totalDialDur time.Duration, lastSuccess, lastFailure time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.successes, h.failures, h.totalDialDur, h.lastSuccess, h.lastFailure
 }
 
 const (
@@ -96,6 +241,36 @@ type SnowflakeClient struct {
 	transport    *sflib.Transport
 	cdnIndex     int
 	dialFailures int32 // atomic; consecutive failures
+	pinnedIdx    int   // index forced by PinCDN, or -1 if unpinned
+	cdnCooldown  time.Duration
+
+	// health holds per-CDN scoring state, indexed like cdnConfigs.
+	health []*cdnHealth
+
+	// state persists health and selection across Stop/Start and process
+	// restarts. Guarded by transportMu like the rest of the selection state.
+	state        StateStore
+	lastICETypes []string
+
+	// dohProxies holds one local CommunicationProxy per distinct DoH
+	// server in use, keyed by dohServer and created lazily. See doh.go.
+	dohProxyMu sync.Mutex
+	dohProxies map[string]*dohProxy
+
+	// Metered/data-budget accounting; see budget.go. budgetMu guards budget
+	// and windowStart, the counters are atomic so gomobile callers can poll
+	// Stats() without contending with in-flight connections.
+	budgetMu    sync.Mutex
+	budget      *Budget
+	windowStart time.Time
+	bytesIn     int64
+	bytesOut    int64
+	activeConns int64
+	throttled   int32
+
+	// udpAssociateEnabled gates SOCKS5 UDP ASSOCIATE; see
+	// SetUDPAssociateEnabled.
+	udpAssociateEnabled int32 // atomic bool
 }
 
 // NewClient creates a new Snowflake PT client with multi-CDN fallback.
@@ -103,7 +278,9 @@ type SnowflakeClient struct {
 // Pass empty strings to use defaults. Built-in fallback CDNs are added
 // automatically.
 // frontDomains and stunURLs are comma-separated lists.
-func NewClient(listenAddr, brokerURL, frontDomains, stunURLs, utlsClientID, ampCacheURL string) (*SnowflakeClient, error) {
+// stateStore, if non-nil, is used to persist and restore CDN health and
+// selection across Stop/Start and process restarts; pass nil to disable.
+func NewClient(listenAddr, brokerURL, frontDomains, stunURLs, utlsClientID, ampCacheURL string, stateStore StateStore) (*SnowflakeClient, error) {
 	if listenAddr == "" {
 		return nil, fmt.Errorf("listen address is required")
 	}
@@ -135,14 +312,61 @@ func NewClient(listenAddr, brokerURL, frontDomains, stunURLs, utlsClientID, ampC
 		cdnConfigs = builtinCDNs
 	}
 
+	health := make([]*cdnHealth, len(cdnConfigs))
+	for i := range health {
+		health[i] = &cdnHealth{}
+	}
+
+	if stateStore == nil {
+		stateStore = noopStateStore{}
+	}
+
 	return &SnowflakeClient{
 		listenAddr:   listenAddr,
 		cdnConfigs:   cdnConfigs,
 		iceAddresses: splitTrimmed(stunURLs),
 		utlsClientID: utlsClientID,
+		pinnedIdx:    -1,
+		cdnCooldown:  defaultCDNCooldown,
+		health:       health,
+		state:        stateStore,
 	}, nil
 }
 
+// SetUDPAssociateEnabled opts into SOCKS5 UDP ASSOCIATE support. It is off
+// by default: the length-prefixed datagram framing in udp_relay.go is a
+// client-local protocol that has no decoder on the other end of a stock
+// Snowflake/Tor bridge, so datagrams sent this way are never unwrapped
+// there and UDP ASSOCIATE cannot reach anything against the public
+// Snowflake network. Only enable this when the configured CDN/broker is
+// known to terminate in a cooperating exit that speaks the same framing.
+func (c *SnowflakeClient) SetUDPAssociateEnabled(enabled bool) {
+	v := int32(0)
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&c.udpAssociateEnabled, v)
+}
+
+// SetCDNCooldown overrides how long a CDN is deprioritized after its most
+// recent dial attempt failed. Must be called before Start().
+func (c *SnowflakeClient) SetCDNCooldown(d time.Duration) {
+	c.transportMu.Lock()
+	defer c.transportMu.Unlock()
+	c.cdnCooldown = d
+}
+
+// RecordICECandidateTypes notes the ICE candidate types (e.g. "host",
+// "srflx", "relay") used by the most recently successful connection, for
+// inclusion in the next persisted state. The mobile host app, which has
+// access to platform WebRTC stats, is expected to call this after a
+// successful connection.
+func (c *SnowflakeClient) RecordICECandidateTypes(types []string) {
+	c.transportMu.Lock()
+	defer c.transportMu.Unlock()
+	c.lastICETypes = append([]string(nil), types...)
+}
+
 // Start begins the Snowflake PT SOCKS5 server in a background goroutine.
 func (c *SnowflakeClient) Start() error {
 	c.mu.Lock()
@@ -169,25 +393,23 @@ func (c *SnowflakeClient) Start() error {
 		ln.Close()
 	}()
 
-	// Create initial transport, trying each CDN config until one works.
-	var transport *sflib.Transport
-	var lastErr error
-	for i := range c.cdnConfigs {
-		transport, lastErr = c.createTransport(i)
-		if lastErr == nil {
-			c.cdnIndex = i
-			break
-		}
-		log.Printf("Snowflake: CDN %d/%d failed to init: %v, trying next...",
-			i+1, len(c.cdnConfigs), lastErr)
-	}
-	if transport == nil {
+	c.restoreState()
+
+	// Select an initial transport by racing the top-scored CDN candidates.
+	transport, idx, err := c.raceTransports(ctx, c.candidates())
+	if err != nil {
 		ln.Close()
 		cancel()
 		c.running = false
-		return fmt.Errorf("all CDN configs failed, last error: %v", lastErr)
+		return fmt.Errorf("all raced CDN candidates failed, last error: %v", err)
 	}
+	c.transportMu.Lock()
 	c.transport = transport
+	c.cdnIndex = idx
+	c.transportMu.Unlock()
+	c.persistState()
+
+	go c.reevaluateLoop(ctx)
 
 	go func() {
 		defer func() {
@@ -205,9 +427,303 @@ func (c *SnowflakeClient) Start() error {
 	return nil
 }
 
+// candidates returns up to raceCandidates CDN indices ordered by health
+// score, best first. If a CDN is pinned, it is the sole candidate.
+func (c *SnowflakeClient) candidates() []int {
+	c.transportMu.Lock()
+	pinned := c.pinnedIdx
+	c.transportMu.Unlock()
+
+	if pinned >= 0 && pinned < len(c.cdnConfigs) {
+		return []int{pinned}
+	}
+
+	c.transportMu.Lock()
+	cooldown := c.cdnCooldown
+	c.transportMu.Unlock()
+
+	indices := make([]int, 0, len(c.cdnConfigs))
+	for i := range c.cdnConfigs {
+		if !c.health[i].inCooldown(cooldown) {
+			indices = append(indices, i)
+		}
+	}
+	if len(indices) == 0 {
+		// Everything is in cooldown — better to retry something than to
+		// report a hard failure.
+		for i := range c.cdnConfigs {
+			indices = append(indices, i)
+		}
+	}
+
+	sort.Slice(indices, func(a, b int) bool {
+		return c.health[indices[a]].score() > c.health[indices[b]].score()
+	})
+	if len(indices) > raceCandidates {
+		indices = indices[:raceCandidates]
+	}
+	return indices
+}
+
+// restoreState loads any previously persisted CDN health and selection,
+// seeding health scores so candidates() favors whatever was known-good
+// last time without needing to re-probe from a blank slate.
+func (c *SnowflakeClient) restoreState() {
+	c.transportMu.Lock()
+	defer c.transportMu.Unlock()
+
+	saved, err := c.state.Load()
+	if err != nil {
+		log.Printf("Snowflake: failed to load persisted state: %v", err)
+		return
+	}
+	if saved == nil {
+		return
+	}
+
+	byBroker := make(map[string]int, len(c.cdnConfigs))
+	for i, cdn := range c.cdnConfigs {
+		byBroker[cdn.brokerURL] = i
+	}
+
+	for _, h := range decodeCDNHealth(saved.CDNHealthJSON) {
+		idx, ok := byBroker[h.BrokerURL]
+		if !ok {
+			continue
+		}
+		c.health[idx].restore(h.Successes, h.Failures, time.Duration(h.TotalDialMS)*time.Millisecond, h.LastSuccess, h.LastFailure)
+	}
+
+	if idx, ok := byBroker[saved.LastGoodBrokerURL]; ok {
+		c.cdnIndex = idx
+	}
+	if saved.LastICETypesCSV != "" {
+		c.lastICETypes = splitTrimmed(saved.LastICETypesCSV)
+	}
+}
+
+// persistState saves the current CDN health and selection via the
+// configured StateStore. Errors are logged, not returned, since a failed
+// save should never prevent the client from running.
+func (c *SnowflakeClient) persistState() {
+	c.transportMu.Lock()
+	defer c.transportMu.Unlock()
+
+	state := &PersistedState{
+		LastGoodBrokerURL: c.cdnConfigs[c.cdnIndex].brokerURL,
+		UTLSFingerprint:   c.utlsClientID,
+		LastICETypesCSV:   strings.Join(c.lastICETypes, ","),
+	}
+
+	health := make([]persistedCDNHealth, 0, len(c.cdnConfigs))
+	for i, cdn := range c.cdnConfigs {
+		successes, failures, totalDialDur, lastSuccess, lastFailure := c.health[i].snapshot()
+		health = append(health, persistedCDNHealth{
+			BrokerURL:   cdn.brokerURL,
+			Successes:   successes,
+			Failures:    failures,
+			TotalDialMS: totalDialDur.Milliseconds(),
+			LastSuccess: lastSuccess,
+			LastFailure: lastFailure,
+		})
+	}
+	state.CDNHealthJSON = encodeCDNHealth(health)
+
+	if err := c.state.Save(state); err != nil {
+		log.Printf("Snowflake: failed to persist state: %v", err)
+	}
+}
+
+// closeTransport tears down an *sflib.Transport. It is used whenever a
+// transport is discarded without ever being installed as c.transport: a
+// losing racer, a one-off bridge-line dial, a transport being replaced by
+// switchTransport, etc. This calls Transport.Close() directly rather than
+// through an io.Closer type assertion: every "we close it" claim in this
+// series depends on that method existing, so a missing Close() should be
+// a compile error here, not a silently swallowed no-op.
+func closeTransport(t *sflib.Transport) {
+	if t == nil {
+		return
+	}
+	t.Close()
+}
+
+// transportClosingConn wraps a net.Conn dialed from a one-off transport
+// (see dialForRequest's bridge-line path) so that closing the connection
+// — which callers already do via defer — also tears down the transport
+// that owns it. The pooled transport path doesn't need this: that
+// transport is shared across connections and torn down separately, by
+// switchTransport.
+type transportClosingConn struct {
+	net.Conn
+	transport *sflib.Transport
+}
+
+func (t *transportClosingConn) Close() error {
+	err := t.Conn.Close()
+	closeTransport(t.transport)
+	return err
+}
+
+// raceTransports builds transports for the given candidate indices in
+// parallel and returns the first one that also completes a real trial
+// dial, so timing and "first working" selection reflect actual broker/
+// rendezvous reachability rather than just local object construction.
+// The winner's trial connection is closed immediately — handle() dials
+// again per SOCKS5 connection, same as the pooled transport path — so the
+// probe only costs one extra round trip, not a held-open stream. Every
+// racer always reports its result on the (fully buffered) results
+// channel; once a winner is picked, a background goroutine drains the
+// rest and closes any transport that still succeeds after losing, so no
+// racer's transport is ever silently leaked.
+func (c *SnowflakeClient) raceTransports(ctx context.Context, indices []int) (*sflib.Transport, int, error) {
+	if len(indices) == 0 {
+		return nil, 0, fmt.Errorf("no CDN candidates available")
+	}
+
+	type result struct {
+		idx       int
+		transport *sflib.Transport
+		err       error
+	}
+	results := make(chan result, len(indices))
+
+	for _, idx := range indices {
+		idx := idx
+		go func() {
+			start := time.Now()
+			transport, err := c.createTransport(idx)
+			if err == nil {
+				probe, derr := transport.Dial()
+				if derr != nil {
+					err = fmt.Errorf("trial dial: %v", derr)
+				} else {
+					probe.Close()
+				}
+			}
+			if err == nil {
+				c.health[idx].recordSuccess(time.Since(start))
+			} else {
+				c.health[idx].recordFailure()
+			}
+			results <- result{idx: idx, transport: transport, err: err}
+		}()
+	}
+
+	var lastErr error
+	for i := 0; i < len(indices); i++ {
+		select {
+		case res := <-results:
+			if res.err == nil {
+				// Drain and close whatever the remaining racers produce —
+				// every one of them loses regardless of its own outcome,
+				// so every one of them is torn down, not just the ones
+				// that happened to also succeed.
+				remaining := len(indices) - i - 1
+				go func() {
+					for j := 0; j < remaining; j++ {
+						closeTransport((<-results).transport)
+					}
+				}()
+				return res.transport, res.idx, nil
+			}
+			closeTransport(res.transport)
+			lastErr = res.err
+		case <-ctx.Done():
+			remaining := len(indices) - i
+			go func() {
+				for j := 0; j < remaining; j++ {
+					closeTransport((<-results).transport)
+				}
+			}()
+			return nil, 0, ctx.Err()
+		}
+	}
+	return nil, 0, lastErr
+}
+
+// reevaluateLoop periodically re-scores CDNs and switches away from the
+// current one if a higher-scoring candidate has emerged. It exits when
+// ctx is canceled (i.e. on Stop()).
+func (c *SnowflakeClient) reevaluateLoop(ctx context.Context) {
+	ticker := time.NewTicker(reEvalInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.reevaluate(ctx)
+		}
+	}
+}
+
+// reevaluate compares the current CDN's score against the best candidate
+// and switches if the candidate's score is strictly higher; there is no
+// minimum margin. No-op while pinned.
+func (c *SnowflakeClient) reevaluate(ctx context.Context) {
+	c.transportMu.Lock()
+	pinned := c.pinnedIdx
+	current := c.cdnIndex
+	c.transportMu.Unlock()
+	if pinned >= 0 {
+		return
+	}
+
+	best := c.candidates()
+	if len(best) == 0 || best[0] == current {
+		return
+	}
+	if c.health[best[0]].score() <= c.health[current].score() {
+		return
+	}
+
+	transport, idx, err := c.raceTransports(ctx, best)
+	if err != nil {
+		log.Printf("Snowflake: re-evaluation found no working CDN: %v", err)
+		return
+	}
+	c.switchTransport(idx, transport)
+}
+
+// switchTransport installs a newly-created transport as current, tearing
+// down the previous one with closeTransport.
+func (c *SnowflakeClient) switchTransport(idx int, transport *sflib.Transport) {
+	c.transportMu.Lock()
+	old := c.transport
+	c.transport = transport
+	c.cdnIndex = idx
+	atomic.StoreInt32(&c.dialFailures, 0)
+	c.transportMu.Unlock()
+
+	closeTransport(old)
+	log.Printf("Snowflake: switched to CDN %d/%d", idx+1, len(c.cdnConfigs))
+	c.persistState()
+}
+
 // createTransport builds a Snowflake transport for the given CDN index.
 func (c *SnowflakeClient) createTransport(idx int) (*sflib.Transport, error) {
 	cdn := c.cdnConfigs[idx]
+	switch cdn.rendezvous {
+	case RendezvousAMP:
+		log.Printf("Snowflake: using CDN %d/%d — AMP cache=%s broker=%s fronts=%v",
+			idx+1, len(c.cdnConfigs), cdn.ampCacheURL, cdn.brokerURL, cdn.frontDomains)
+	case RendezvousDoH:
+		log.Printf("Snowflake: using CDN %d/%d — DoH=%s broker=%s",
+			idx+1, len(c.cdnConfigs), cdn.dohServer, cdn.brokerURL)
+	case RendezvousSQS:
+		log.Printf("Snowflake: using CDN %d/%d — SQS queue=%s", idx+1, len(c.cdnConfigs), cdn.sqsQueueURL)
+	default:
+		log.Printf("Snowflake: using CDN %d/%d — broker=%s fronts=%v",
+			idx+1, len(c.cdnConfigs), cdn.brokerURL, cdn.frontDomains)
+	}
+	return c.buildTransport(cdn)
+}
+
+// buildTransport turns a cdnConfig into an sflib.ClientConfig and builds
+// the transport. Shared by the pooled, scored CDN list (createTransport)
+// and one-off per-connection bridge lines (see bridgeline.go).
+func (c *SnowflakeClient) buildTransport(cdn cdnConfig) (*sflib.Transport, error) {
 	config := sflib.ClientConfig{
 		BrokerURL:     cdn.brokerURL,
 		AmpCacheURL:   cdn.ampCacheURL,
@@ -217,42 +733,166 @@ func (c *SnowflakeClient) createTransport(idx int) (*sflib.Transport, error) {
 		UTLSClientID:  c.utlsClientID,
 		UTLSRemoveSNI: true,
 	}
-	if cdn.ampCacheURL != "" {
-		log.Printf("Snowflake: using CDN %d/%d — AMP cache=%s broker=%s fronts=%v",
-			idx+1, len(c.cdnConfigs), cdn.ampCacheURL, cdn.brokerURL, cdn.frontDomains)
-	} else {
-		log.Printf("Snowflake: using CDN %d/%d — broker=%s fronts=%v",
-			idx+1, len(c.cdnConfigs), cdn.brokerURL, cdn.frontDomains)
+
+	switch cdn.rendezvous {
+	case RendezvousSQS:
+		config.SQSQueueURL = cdn.sqsQueueURL
+		config.SQSCredsStr = cdn.sqsCredsB64
+	case RendezvousDoH:
+		proxy, err := c.dohProxyFor(cdn.dohServer)
+		if err != nil {
+			return nil, fmt.Errorf("doh proxy for %s: %v", cdn.dohServer, err)
+		}
+		config.CommunicationProxy = proxy.proxyURL()
 	}
+
 	return sflib.NewSnowflakeClient(config)
 }
 
-// rotateCDN switches to the next CDN configuration.
-// Called when consecutive dial failures exceed the threshold.
+// dohProxyFor returns the local CommunicationProxy for dohServer, starting
+// one if this is the first cdnConfig to use it. Proxies are kept running
+// for the client's lifetime and closed in Stop(), since they may still be
+// backing an in-flight transport at any time.
+func (c *SnowflakeClient) dohProxyFor(dohServer string) (*dohProxy, error) {
+	c.dohProxyMu.Lock()
+	defer c.dohProxyMu.Unlock()
+
+	if proxy, ok := c.dohProxies[dohServer]; ok {
+		return proxy, nil
+	}
+	proxy, err := newDoHProxy(dohServer)
+	if err != nil {
+		return nil, err
+	}
+	if c.dohProxies == nil {
+		c.dohProxies = make(map[string]*dohProxy)
+	}
+	c.dohProxies[dohServer] = proxy
+	return proxy, nil
+}
+
+// rotateCDN switches away from the current CDN configuration, picking the
+// best-scoring alternative. Called when consecutive dial failures exceed
+// the threshold. No-op while pinned, since the user has forced a choice.
 func (c *SnowflakeClient) rotateCDN() {
 	c.transportMu.Lock()
-	defer c.transportMu.Unlock()
+	pinned := c.pinnedIdx
+	current := c.cdnIndex
+	c.transportMu.Unlock()
+	if pinned >= 0 {
+		return
+	}
+
+	next := make([]int, 0, len(c.cdnConfigs)-1)
+	for _, idx := range c.candidates() {
+		if idx != current {
+			next = append(next, idx)
+		}
+	}
+	if len(next) == 0 {
+		next = []int{(current + 1) % len(c.cdnConfigs)}
+	}
 
-	nextIdx := (c.cdnIndex + 1) % len(c.cdnConfigs)
-	log.Printf("Snowflake: CDN %d failed after %d attempts, rotating to CDN %d/%d",
-		c.cdnIndex+1, maxDialFailures, nextIdx+1, len(c.cdnConfigs))
+	log.Printf("Snowflake: CDN %d failed after %d attempts, rotating away",
+		current+1, maxDialFailures)
 
-	transport, err := c.createTransport(nextIdx)
+	transport, idx, err := c.raceTransports(context.Background(), next)
 	if err != nil {
-		log.Printf("Snowflake: failed to create transport for CDN %d: %v", nextIdx+1, err)
+		log.Printf("Snowflake: failed to create transport while rotating: %v", err)
 		return
 	}
+	c.switchTransport(idx, transport)
+}
+
+// ForceRotate immediately switches to the best-scoring alternative CDN,
+// clearing any pin set by PinCDN. Intended for a manual "try another
+// bridge" action in the mobile UI.
+func (c *SnowflakeClient) ForceRotate() error {
+	c.transportMu.Lock()
+	current := c.cdnIndex
+	c.pinnedIdx = -1
+	c.transportMu.Unlock()
+
+	next := make([]int, 0, len(c.cdnConfigs)-1)
+	for _, idx := range c.candidates() {
+		if idx != current {
+			next = append(next, idx)
+		}
+	}
+	if len(next) == 0 {
+		return fmt.Errorf("no alternative CDN available")
+	}
 
-	c.transport = transport
-	c.cdnIndex = nextIdx
-	atomic.StoreInt32(&c.dialFailures, 0)
+	transport, idx, err := c.raceTransports(context.Background(), next)
+	if err != nil {
+		return fmt.Errorf("force rotate: %v", err)
+	}
+	c.switchTransport(idx, transport)
+	return nil
 }
 
-// getTransport returns the current transport (thread-safe).
-func (c *SnowflakeClient) getTransport() *sflib.Transport {
+// PinCDN forces the client onto a specific CDN, disabling automatic
+// rotation and re-evaluation until ForceRotate or PinCDN is called again.
+func (c *SnowflakeClient) PinCDN(index int) error {
+	if index < 0 || index >= len(c.cdnConfigs) {
+		return fmt.Errorf("CDN index %d out of range [0, %d)", index, len(c.cdnConfigs))
+	}
+
+	transport, _, err := c.raceTransports(context.Background(), []int{index})
+	if err != nil {
+		return fmt.Errorf("pin CDN %d: %v", index, err)
+	}
+
 	c.transportMu.Lock()
-	defer c.transportMu.Unlock()
-	return c.transport
+	c.pinnedIdx = index
+	c.transportMu.Unlock()
+	c.switchTransport(index, transport)
+	return nil
+}
+
+// CDNStat is a point-in-time snapshot of one CDN's health, for display in
+// the mobile UI.
+type CDNStat struct {
+	Index               int
+	BrokerURL           string
+	Active              bool
+	Pinned              bool
+	Successes           int64
+	Failures            int64
+	MeanDialLatencyMS   int64
+	SecondsSinceSuccess int64 // -1 if never succeeded
+}
+
+// GetCDNStats returns a snapshot of health stats for every configured CDN.
+func (c *SnowflakeClient) GetCDNStats() []CDNStat {
+	c.transportMu.Lock()
+	current := c.cdnIndex
+	pinned := c.pinnedIdx
+	c.transportMu.Unlock()
+
+	stats := make([]CDNStat, len(c.cdnConfigs))
+	for i, cdn := range c.cdnConfigs {
+		successes, failures, totalDialDur, lastSuccess, _ := c.health[i].snapshot()
+		var meanLatency time.Duration
+		if successes > 0 {
+			meanLatency = totalDialDur / time.Duration(successes)
+		}
+		secondsSince := int64(-1)
+		if !lastSuccess.IsZero() {
+			secondsSince = int64(time.Since(lastSuccess).Seconds())
+		}
+		stats[i] = CDNStat{
+			Index:               i,
+			BrokerURL:           cdn.brokerURL,
+			Active:              i == current,
+			Pinned:              i == pinned,
+			Successes:           successes,
+			Failures:            failures,
+			MeanDialLatencyMS:   meanLatency.Milliseconds(),
+			SecondsSinceSuccess: secondsSince,
+		}
+	}
+	return stats
 }
 
 // Stop shuts down the Snowflake PT.
@@ -260,6 +900,10 @@ func (c *SnowflakeClient) Stop() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.running {
+		c.persistState()
+	}
+
 	if c.cancel != nil {
 		c.cancel()
 		c.cancel = nil
@@ -269,9 +913,18 @@ func (c *SnowflakeClient) Stop() {
 		c.listener = nil
 	}
 	c.running = false
+
+	c.dohProxyMu.Lock()
+	for _, proxy := range c.dohProxies {
+		proxy.close()
+	}
+	c.dohProxies = nil
+	c.dohProxyMu.Unlock()
 }
 
-// IsRunning returns whether the client is currently running.
+// IsRunning returns whether the client is currently running. A throttled
+// client (see IsThrottled) still reports true here — it's running, just
+// refusing new connections until its Budget window rolls over.
 func (c *SnowflakeClient) IsRunning() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -304,87 +957,116 @@ func (c *SnowflakeClient) run(ctx context.Context, ln net.Listener) error {
 // handle proxies a single connection through Snowflake.
 // Tor connects via SOCKS5 (ClientTransportPlugin ... socks5), so we must
 // complete the SOCKS5 handshake before proxying raw data through WebRTC.
+// CONNECT is supported; UDP ASSOCIATE is refused unless enabled with
+// SetUDPAssociateEnabled. See internal/socks5 for the handshake itself.
 func (c *SnowflakeClient) handle(ctx context.Context, local net.Conn) error {
-	// --- SOCKS5 handshake (RFC 1928) ---
-	// 1. Greeting: client sends [VER, NMETHODS, METHODS...]
-	buf := make([]byte, 256)
-	if _, err := io.ReadFull(local, buf[:2]); err != nil {
-		return fmt.Errorf("socks5 greeting: %v", err)
-	}
-	if buf[0] != 0x05 {
-		return fmt.Errorf("socks5: unsupported version %d", buf[0])
-	}
-	nMethods := int(buf[1])
-	if _, err := io.ReadFull(local, buf[:nMethods]); err != nil {
-		return fmt.Errorf("socks5 methods: %v", err)
-	}
-	// Reply: no authentication required (method 0x00)
-	if _, err := local.Write([]byte{0x05, 0x00}); err != nil {
-		return fmt.Errorf("socks5 greeting reply: %v", err)
-	}
-
-	// 2. Connect request: [VER, CMD, RSV, ATYP, DST.ADDR, DST.PORT]
-	if _, err := io.ReadFull(local, buf[:4]); err != nil {
-		return fmt.Errorf("socks5 request header: %v", err)
-	}
-	// Skip the destination address — Snowflake always connects to the bridge.
-	atyp := buf[3]
-	switch atyp {
-	case 0x01: // IPv4: 4 bytes + 2 port
-		if _, err := io.ReadFull(local, buf[:6]); err != nil {
-			return fmt.Errorf("socks5 ipv4 addr: %v", err)
-		}
-	case 0x03: // Domain: 1 len + domain + 2 port
-		if _, err := io.ReadFull(local, buf[:1]); err != nil {
-			return fmt.Errorf("socks5 domain len: %v", err)
-		}
-		domLen := int(buf[0])
-		if _, err := io.ReadFull(local, buf[:domLen+2]); err != nil {
-			return fmt.Errorf("socks5 domain addr: %v", err)
-		}
-	case 0x04: // IPv6: 16 bytes + 2 port
-		if _, err := io.ReadFull(local, buf[:18]); err != nil {
-			return fmt.Errorf("socks5 ipv6 addr: %v", err)
+	req, err := socks5.Handshake(local)
+	if err != nil {
+		return fmt.Errorf("socks5 handshake: %v", err)
+	}
+
+	switch req.Cmd {
+	case socks5.CmdConnect:
+		return c.handleConnect(local, req)
+	case socks5.CmdUDPAssociate:
+		if atomic.LoadInt32(&c.udpAssociateEnabled) == 0 {
+			socks5.WriteReply(local, socks5.ReplyCommandNotSupported, "", 0)
+			return fmt.Errorf("socks5: UDP ASSOCIATE disabled (see SetUDPAssociateEnabled)")
 		}
+		return c.handleUDPAssociate(ctx, local, req)
 	default:
-		return fmt.Errorf("socks5: unsupported address type %d", atyp)
+		socks5.WriteReply(local, socks5.ReplyCommandNotSupported, "", 0)
+		return fmt.Errorf("socks5: unsupported command %d", req.Cmd)
 	}
+}
 
-	// Reply: success (bound address 0.0.0.0:0)
-	reply := []byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
-	if _, err := local.Write(reply); err != nil {
-		return fmt.Errorf("socks5 connect reply: %v", err)
+// handleConnect proxies a single CONNECT request through Snowflake.
+func (c *SnowflakeClient) handleConnect(local net.Conn, req *socks5.Request) error {
+	// Reject new connections fast if the data budget is already exceeded,
+	// rather than burning a WebRTC dial on a connection we'll just throttle.
+	if c.checkBudget() {
+		socks5.WriteReply(local, socks5.ReplyGeneralFailure, "", 0)
+		return ErrThrottled
 	}
 
-	// --- Proxy raw data through Snowflake WebRTC ---
-	transport := c.getTransport()
-	remote, err := transport.Dial()
+	remote, err := c.dialForRequest(req)
 	if err != nil {
-		// Track consecutive failures for CDN rotation.
-		failures := atomic.AddInt32(&c.dialFailures, 1)
-		if failures >= maxDialFailures {
-			c.rotateCDN()
-		}
+		socks5.WriteReply(local, socks5.ReplyGeneralFailure, "", 0)
 		return fmt.Errorf("snowflake dial: %v", err)
 	}
-	// Reset failure counter on success.
-	atomic.StoreInt32(&c.dialFailures, 0)
 	defer remote.Close()
 
+	if err := socks5.WriteReply(local, socks5.ReplySucceeded, "", 0); err != nil {
+		return fmt.Errorf("socks5 connect reply: %v", err)
+	}
+
+	atomic.AddInt64(&c.activeConns, 1)
+	defer atomic.AddInt64(&c.activeConns, -1)
+
+	// Wrap each side's Read with a byte counter: reading from local is
+	// upload (bytesOut), reading from remote is download (bytesIn). This
+	// counts every relayed byte exactly once.
+	countingLocal := &countingConn{Conn: local, counter: &c.bytesOut}
+	countingRemote := &countingConn{Conn: remote, counter: &c.bytesIn}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		io.Copy(remote, local)
+		io.Copy(remote, countingLocal)
 	}()
 	go func() {
 		defer wg.Done()
-		io.Copy(local, remote)
+		io.Copy(local, countingRemote)
 	}()
 	wg.Wait()
 	return nil
 }
 
+// dialForRequest opens a Snowflake stream for one SOCKS5 request. If the
+// client supplied a bridge line via its SOCKS5 password (see
+// bridgeline.go), that ad-hoc CDN is dialed directly and does not affect
+// the pooled transport's health scoring or rotation. Otherwise the
+// current pooled transport is used, and dial outcomes feed back into CDN
+// health/rotation as usual.
+func (c *SnowflakeClient) dialForRequest(req *socks5.Request) (net.Conn, error) {
+	if cdn, ok := parseBridgeLine(req.Password); ok {
+		transport, err := c.buildTransport(cdn)
+		if err != nil {
+			return nil, fmt.Errorf("bridge line transport: %v", err)
+		}
+		conn, err := transport.Dial()
+		if err != nil {
+			closeTransport(transport)
+			return nil, err
+		}
+		// The bridge-line transport is one-off and not pooled anywhere
+		// else, so it must be torn down when this connection is — wrap it
+		// so the caller's existing defer remote.Close() does that too.
+		return &transportClosingConn{Conn: conn, transport: transport}, nil
+	}
+
+	c.transportMu.Lock()
+	transport, dialIdx := c.transport, c.cdnIndex
+	c.transportMu.Unlock()
+
+	dialStart := time.Now()
+	remote, err := transport.Dial()
+	if err != nil {
+		c.health[dialIdx].recordFailure()
+		// Track consecutive failures for CDN rotation.
+		failures := atomic.AddInt32(&c.dialFailures, 1)
+		if failures >= maxDialFailures {
+			c.rotateCDN()
+		}
+		return nil, err
+	}
+	c.health[dialIdx].recordSuccess(time.Since(dialStart))
+	// Reset failure counter on success.
+	atomic.StoreInt32(&c.dialFailures, 0)
+	return remote, nil
+}
+
 // splitTrimmed splits a comma-separated string into a trimmed slice,
 // filtering out empty entries.
 func splitTrimmed(s string) []string {
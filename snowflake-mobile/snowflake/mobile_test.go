@@ -0,0 +1,65 @@
+package snowflake
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCDNHealthScoreNeutralWithNoHistory(t *testing.T) {
+	h := &cdnHealth{}
+	if got := h.score(); got != 0.5 {
+		t.Errorf("score() with no history = %v, want 0.5", got)
+	}
+}
+
+func TestCDNHealthScorePrefersFasterAndMoreReliable(t *testing.T) {
+	fast := &cdnHealth{}
+	fast.recordSuccess(10 * time.Millisecond)
+	fast.recordSuccess(10 * time.Millisecond)
+
+	slow := &cdnHealth{}
+	slow.recordSuccess(time.Second)
+	slow.recordFailure()
+
+	if fast.score() <= slow.score() {
+		t.Errorf("fast.score() = %v, want > slow.score() = %v", fast.score(), slow.score())
+	}
+}
+
+func TestCDNHealthInCooldown(t *testing.T) {
+	h := &cdnHealth{}
+	if h.inCooldown(time.Minute) {
+		t.Error("fresh cdnHealth should not be in cooldown")
+	}
+
+	h.recordFailure()
+	if !h.inCooldown(time.Minute) {
+		t.Error("cdnHealth with a recent failure and no success should be in cooldown")
+	}
+	if h.inCooldown(0) {
+		t.Error("a zero cooldown window should never report in-cooldown")
+	}
+
+	h.recordSuccess(time.Millisecond)
+	if h.inCooldown(time.Minute) {
+		t.Error("cdnHealth should leave cooldown once a success follows the failure")
+	}
+}
+
+func TestCDNHealthRestoreAndSnapshot(t *testing.T) {
+	h := &cdnHealth{}
+	lastSuccess := time.Now().Add(-time.Hour)
+	lastFailure := time.Now().Add(-time.Minute)
+	h.restore(5, 2, 300*time.Millisecond, lastSuccess, lastFailure)
+
+	successes, failures, totalDialDur, gotSuccess, gotFailure := h.snapshot()
+	if successes != 5 || failures != 2 || totalDialDur != 300*time.Millisecond {
+		t.Errorf("snapshot() counts = (%d, %d, %v), want (5, 2, 300ms)", successes, failures, totalDialDur)
+	}
+	if !gotSuccess.Equal(lastSuccess) || !gotFailure.Equal(lastFailure) {
+		t.Errorf("snapshot() timestamps = (%v, %v), want (%v, %v)", gotSuccess, gotFailure, lastSuccess, lastFailure)
+	}
+	if !h.inCooldown(time.Hour) {
+		t.Error("restored state with failure after success should be in cooldown")
+	}
+}
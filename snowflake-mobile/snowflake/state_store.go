@@ -0,0 +1,148 @@
+package snowflake
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StateStore persists SnowflakeClient's learned CDN state across process
+// restarts, so a cold Start() after a mobile suspend/resume cycle can skip
+// re-probing CDNs that are already known-good (or known-bad).
+type StateStore interface {
+	// Load returns the last-saved state, or (nil, nil) if none exists yet.
+	Load() (*PersistedState, error)
+	// Save atomically overwrites the stored state.
+	Save(state *PersistedState) error
+}
+
+// PersistedState is the on-disk representation of a SnowflakeClient's
+// learned CDN state. StateStore is part of NewClient's gomobile-facing
+// API, so every field here is a gomobile-bindable primitive (string/int):
+// no time.Time, and no slice-of-struct or non-byte slice. LastICETypes and
+// the per-CDN health history are carried as encoded strings and packed/
+// unpacked on the Go side (see encodeCDNHealth/decodeCDNHealth below and
+// splitTrimmed/strings.Join at the call sites in mobile.go).
+type PersistedState struct {
+	LastGoodBrokerURL string `json:"lastGoodBrokerURL"`
+	UTLSFingerprint   string `json:"utlsFingerprint"`
+	LastICETypesCSV   string `json:"lastICETypesCSV,omitempty"`
+	CDNHealthJSON     string `json:"cdnHealthJSON,omitempty"`
+}
+
+// persistedCDNHealth is the saved health history for one CDN, matched back
+// to a cdnConfig by brokerURL rather than index (config order can change
+// between runs). It is never itself part of the gomobile-bound API — it
+// only exists JSON-encoded inside PersistedState.CDNHealthJSON.
+type persistedCDNHealth struct {
+	BrokerURL   string    `json:"brokerURL"`
+	Successes   int64     `json:"successes"`
+	Failures    int64     `json:"failures"`
+	TotalDialMS int64     `json:"totalDialMs"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	LastFailure time.Time `json:"lastFailure"`
+}
+
+// encodeCDNHealth serializes a CDN health list for storage in
+// PersistedState.CDNHealthJSON. Marshal failure (which can't actually
+// happen for this type) degrades to an empty history rather than a panic.
+func encodeCDNHealth(health []persistedCDNHealth) string {
+	data, err := json.Marshal(health)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// decodeCDNHealth parses a string previously produced by encodeCDNHealth.
+// A missing or malformed value decodes to no history, not an error —
+// restoreState() just has nothing to seed health scores with.
+func decodeCDNHealth(s string) []persistedCDNHealth {
+	if s == "" {
+		return nil
+	}
+	var health []persistedCDNHealth
+	if err := json.Unmarshal([]byte(s), &health); err != nil {
+		return nil
+	}
+	return health
+}
+
+// noopStateStore is used when a SnowflakeClient is constructed without a
+// StateStore, so callers never need to nil-check.
+type noopStateStore struct{}
+
+func (noopStateStore) Load() (*PersistedState, error)   { return nil, nil }
+func (noopStateStore) Save(state *PersistedState) error { return nil }
+
+// FileStateStore persists state to a single file on disk, writing via a
+// temp-file-plus-rename so a crash mid-write cannot corrupt the existing
+// state.
+type FileStateStore struct {
+	path string
+}
+
+// NewFileStateStore creates a FileStateStore backed by the file at path.
+// The containing directory must already exist.
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{path: path}
+}
+
+// Load reads and parses the state file. A missing file is not an error —
+// it simply means no state has been saved yet.
+func (f *FileStateStore) Load() (*PersistedState, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var state PersistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Save writes state to a temp file in the same directory, fsyncs it, then
+// renames it over the real path. The rename is atomic on POSIX
+// filesystems, so readers never observe a partially-written file.
+func (f *FileStateStore) Save(state *PersistedState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := f.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return err
+	}
+
+	// Best-effort: fsync the directory entry so the rename itself survives
+	// a crash. Not fatal if unsupported (e.g. some mobile filesystems).
+	if dir, err := os.Open(filepath.Dir(f.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
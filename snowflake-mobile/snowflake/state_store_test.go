@@ -0,0 +1,68 @@
+package snowflake
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStateStoreLoadMissingFile(t *testing.T) {
+	store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+	state, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if state != nil {
+		t.Fatalf("Load of a missing file = %+v, want nil", state)
+	}
+}
+
+func TestFileStateStoreSaveLoadRoundTrip(t *testing.T) {
+	store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+
+	health := []persistedCDNHealth{
+		{BrokerURL: "https://a.example/", Successes: 3, Failures: 1, TotalDialMS: 450},
+		{BrokerURL: "https://b.example/", Successes: 0, Failures: 2},
+	}
+	want := &PersistedState{
+		LastGoodBrokerURL: "https://a.example/",
+		UTLSFingerprint:   "hellorandomizedalpn",
+		LastICETypesCSV:   "host,srflx",
+		CDNHealthJSON:     encodeCDNHealth(health),
+	}
+
+	if err := store.Save(want); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	got, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got == nil {
+		t.Fatal("Load after Save = nil")
+	}
+	if *got != *want {
+		t.Errorf("Load() = %+v, want %+v", *got, *want)
+	}
+
+	gotHealth := decodeCDNHealth(got.CDNHealthJSON)
+	if len(gotHealth) != len(health) {
+		t.Fatalf("decodeCDNHealth returned %d entries, want %d", len(gotHealth), len(health))
+	}
+	for i := range health {
+		if gotHealth[i].BrokerURL != health[i].BrokerURL || gotHealth[i].Successes != health[i].Successes {
+			t.Errorf("health[%d] = %+v, want %+v", i, gotHealth[i], health[i])
+		}
+	}
+}
+
+func TestNoopStateStore(t *testing.T) {
+	var store noopStateStore
+	state, err := store.Load()
+	if err != nil || state != nil {
+		t.Fatalf("Load() = (%+v, %v), want (nil, nil)", state, err)
+	}
+	if err := store.Save(&PersistedState{}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+}
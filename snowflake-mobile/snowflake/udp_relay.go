@@ -0,0 +1,138 @@
+package snowflake
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"snowflake-mobile/internal/socks5"
+)
+
+// udpRelayBufSize is the max UDP datagram size relayed: the largest
+// payload an IPv4 UDP datagram can carry (65535 minus the 20-byte IP
+// header and the 8-byte UDP header).
+const udpRelayBufSize = 65507
+
+// handleUDPAssociate implements SOCKS5 UDP ASSOCIATE (RFC 1928 §7). It
+// opens a local UDP relay socket, tells the client where to send
+// datagrams, and tunnels them to/from the Snowflake bridge over a
+// dedicated DataChannel stream using length-prefixed framing (UDP has no
+// native representation on a WebRTC DataChannel, which is stream-like).
+//
+// This framing is only ever unwrapped by relayUDPToRemote/
+// relayUDPFromRemote on our own client side — a stock Snowflake bridge
+// just forwards the stream's bytes on as ordinary OR-protocol traffic, so
+// it never reaches a peer that decodes it. Callers must not route this
+// through the public Snowflake network; it only does anything useful
+// paired with a cooperating exit that speaks the same framing. That's why
+// this is only reachable after SetUDPAssociateEnabled(true); see its doc
+// comment in mobile.go.
+func (c *SnowflakeClient) handleUDPAssociate(ctx context.Context, local net.Conn, req *socks5.Request) error {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	if err != nil {
+		socks5.WriteReply(local, socks5.ReplyGeneralFailure, "", 0)
+		return fmt.Errorf("udp associate: listen: %v", err)
+	}
+	defer udpConn.Close()
+
+	bindAddr := udpConn.LocalAddr().(*net.UDPAddr)
+	if err := socks5.WriteReply(local, socks5.ReplySucceeded, bindAddr.IP.String(), uint16(bindAddr.Port)); err != nil {
+		return fmt.Errorf("udp associate reply: %v", err)
+	}
+
+	if c.checkBudget() {
+		return ErrThrottled
+	}
+
+	remote, err := c.dialForRequest(req)
+	if err != nil {
+		return fmt.Errorf("udp associate: snowflake dial: %v", err)
+	}
+	defer remote.Close()
+
+	atomic.AddInt64(&c.activeConns, 1)
+	defer atomic.AddInt64(&c.activeConns, -1)
+
+	// The control TCP connection must stay open for the life of the
+	// association (RFC 1928 §7); it closing or erroring tears down the
+	// relay. We don't expect any payload on it, just EOF/close.
+	ctrlClosed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, local)
+		close(ctrlClosed)
+	}()
+
+	var clientAddr atomic.Value // holds *net.UDPAddr, learned from the first inbound packet
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- c.relayUDPToRemote(udpConn, remote, &clientAddr) }()
+	go func() { errCh <- c.relayUDPFromRemote(udpConn, remote, &clientAddr) }()
+
+	select {
+	case <-ctrlClosed:
+	case <-ctx.Done():
+	case err := <-errCh:
+		if err != nil {
+			log.Printf("snowflake udp relay: %v", err)
+		}
+	}
+	return nil
+}
+
+// relayUDPToRemote reads datagrams the local SOCKS5 client sends to the
+// UDP relay socket, unwraps the RFC 1928 §7 header, and forwards the
+// payload to remote as a length-prefixed frame.
+func (c *SnowflakeClient) relayUDPToRemote(udpConn *net.UDPConn, remote net.Conn, clientAddr *atomic.Value) error {
+	buf := make([]byte, udpRelayBufSize)
+	for {
+		n, addr, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		clientAddr.Store(addr)
+
+		dgram, err := socks5.DecodeUDPDatagram(buf[:n])
+		if err != nil {
+			log.Printf("snowflake udp relay: dropping malformed datagram: %v", err)
+			continue
+		}
+		if err := socks5.WriteFramed(remote, dgram.Data); err != nil {
+			return fmt.Errorf("forwarding udp datagram: %v", err)
+		}
+		atomic.AddInt64(&c.bytesOut, int64(len(dgram.Data)))
+	}
+}
+
+// relayUDPFromRemote reads length-prefixed frames from remote, re-wraps
+// them in the RFC 1928 §7 header, and sends them back to whichever client
+// address last sent a datagram.
+func (c *SnowflakeClient) relayUDPFromRemote(udpConn *net.UDPConn, remote net.Conn, clientAddr *atomic.Value) error {
+	for {
+		payload, err := socks5.ReadFramed(remote)
+		if err != nil {
+			return err
+		}
+		addr, _ := clientAddr.Load().(*net.UDPAddr)
+		if addr == nil {
+			// No client has sent anything yet, so we don't know where to
+			// deliver this; drop it.
+			continue
+		}
+		dgram, err := socks5.EncodeUDPDatagram(&socks5.UDPDatagram{
+			DstAddr: addr.IP.String(),
+			DstPort: uint16(addr.Port),
+			Data:    payload,
+		})
+		if err != nil {
+			log.Printf("snowflake udp relay: encoding reply datagram: %v", err)
+			continue
+		}
+		if _, err := udpConn.WriteToUDP(dgram, addr); err != nil {
+			return fmt.Errorf("sending udp datagram to client: %v", err)
+		}
+		atomic.AddInt64(&c.bytesIn, int64(len(payload)))
+	}
+}